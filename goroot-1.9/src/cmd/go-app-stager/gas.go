@@ -35,10 +35,37 @@
 // go-app-stager can be invoked with a specific Go version via the -go-version
 // flag to override the logic above.
 //
+// For Go 1.16 and later, files named by //go:embed directives in staged
+// dependencies are resolved and copied alongside their package, in addition
+// to the package's Go source files.
+//
+// The -overlay flag accepts a JSON file in the same format as `go build
+// -overlay`, mapping original on-disk paths to replacement files (or to null
+// to delete them). This lets generated or modified files be staged without
+// touching the source tree.
+//
+// For GAE Standard second-gen apps, go.mod `replace` directives with
+// filesystem targets (e.g. `replace example.com/foo => ../foo`) are bundled
+// into the staged output under _local_replace/ and the staged go.mod is
+// rewritten to point at them, since the remote builder has no access to
+// paths outside the uploaded directory. Use -allow-replace-dir to silence
+// the warning logged for a replacement directory outside the module root.
+//
+// By default dependencies are analyzed for GOARCH=amd64, GOOS=linux. Use
+// -goos, -goarch (each a comma-separated list) and -build-tag (repeatable)
+// to stage for additional platforms or build tags; dependency analysis runs
+// once per resulting (GOOS, GOARCH) pair and the staged output is the union
+// of what each run finds. This matters for apps that use //go:build
+// constraints to select platform-specific files.
+//
 // Current codebase assumes Go 1.x versions.
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"crypto/sha1"
+	"encoding/json"
 	"flag"
 	"fmt"
 	"go/build"
@@ -47,11 +74,15 @@ import (
 	"log"
 	"net/http"
 	"os"
+	"os/exec"
 	"path/filepath"
+	"regexp"
+	"sort"
 	"strconv"
 	"strings"
 
 	"appengine_internal/gopkg.in/yaml.v2"
+	"golang.org/x/mod/modfile"
 )
 
 const stdDefaultMinorVersion = 9
@@ -78,6 +109,45 @@ var goVersion = flag.String("go-version", "", "target Go release version, e.g. 1
 var flexRuntimesConfigURL = flag.String("flex-runtimes-url",
 	"http://storage.googleapis.com/runtime-builders/runtimes.yaml", "Flex runtimes.yaml URL")
 
+// Path to a JSON overlay file, mirroring the format accepted by `go build
+// -overlay`, used to stage generated or modified files without touching the
+// source tree.
+var overlayFlag = flag.String("overlay", "", "JSON overlay file mapping on-disk paths to replacement files, as with `go build -overlay`")
+
+// stringSliceFlag accumulates repeated occurrences of a flag into a slice.
+type stringSliceFlag []string
+
+func (s *stringSliceFlag) String() string { return strings.Join(*s, ",") }
+
+func (s *stringSliceFlag) Set(v string) error {
+	*s = append(*s, v)
+	return nil
+}
+
+// Additional directory roots under which a go.mod `replace` directive's
+// filesystem target is allowed without a warning, beyond the module root
+// itself. May be repeated.
+var allowedReplaceDirs stringSliceFlag
+
+func init() {
+	flag.Var(&allowedReplaceDirs, "allow-replace-dir", "additional directory root under which local `replace` directive targets are allowed without a warning (may be repeated)")
+}
+
+// Target GOOS/GOARCH values to stage for, as comma-separated lists. Dependency
+// analysis runs once per (GOOS, GOARCH) pair so apps with //go:build
+// constraints that select platform-specific files produce a complete staged
+// dependency set.
+var goosFlag = flag.String("goos", "", "comma-separated list of GOOS values to stage for (default: linux)")
+var goarchFlag = flag.String("goarch", "", "comma-separated list of GOARCH values to stage for (default: amd64)")
+
+// Additional build tags applied, alongside the runtime-specific tags, when
+// analyzing dependencies. May be repeated.
+var buildTagsFlag stringSliceFlag
+
+func init() {
+	flag.Var(&buildTagsFlag, "build-tag", "additional build tag to apply when analyzing dependencies (may be repeated)")
+}
+
 // Top-level standard library packages, used instead of depending on a Goroot.
 var skippedPackages = map[string]bool{
 	"appengine":          true,
@@ -152,6 +222,215 @@ type importFrom struct {
 	fromDir string
 }
 
+// overlay implements virtual file replacement for staging, mirroring the
+// JSON format accepted by `go build -overlay`: a map of original on-disk
+// paths to replacement file paths, with a nil replacement meaning the
+// original path should be treated as deleted. A nil *overlay is valid and
+// behaves as if no replacements were configured.
+type overlay struct {
+	replace map[string]string // absolute original path -> absolute replacement path; "" means deleted
+}
+
+type overlayFile struct {
+	Replace map[string]*string `json:"Replace"`
+}
+
+// readOverlay parses the JSON overlay file at path. An empty path returns a
+// nil *overlay.
+func readOverlay(path string) (*overlay, error) {
+	if path == "" {
+		return nil, nil
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read overlay file %s: %v", path, err)
+	}
+	var f overlayFile
+	if err := json.Unmarshal(data, &f); err != nil {
+		return nil, fmt.Errorf("failed to parse overlay file %s: %v", path, err)
+	}
+	o := &overlay{replace: make(map[string]string, len(f.Replace))}
+	for orig, repl := range f.Replace {
+		abs, err := filepath.Abs(orig)
+		if err != nil {
+			return nil, fmt.Errorf("overlay path %q: %v", orig, err)
+		}
+		if repl == nil || *repl == "" {
+			o.replace[abs] = ""
+			continue
+		}
+		replAbs, err := filepath.Abs(*repl)
+		if err != nil {
+			return nil, fmt.Errorf("overlay replacement %q: %v", *repl, err)
+		}
+		o.replace[abs] = replAbs
+	}
+	return o, nil
+}
+
+// lookup returns the replacement path for path, if any, and whether path has
+// been deleted by the overlay. Safe to call on a nil *overlay.
+func (o *overlay) lookup(path string) (replacement string, deleted bool) {
+	if o == nil {
+		return "", false
+	}
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return "", false
+	}
+	repl, ok := o.replace[abs]
+	if !ok {
+		return "", false
+	}
+	if repl == "" {
+		return "", true
+	}
+	return repl, false
+}
+
+// openFile opens path, honoring the overlay's replacements and deletions. It
+// matches the signature of build.Context.OpenFile.
+func (o *overlay) openFile(path string) (io.ReadCloser, error) {
+	if repl, deleted := o.lookup(path); deleted {
+		return nil, os.ErrNotExist
+	} else if repl != "" {
+		path = repl
+	}
+	return os.Open(path)
+}
+
+// stat stats path, honoring the overlay's replacements and deletions.
+func (o *overlay) stat(path string) (os.FileInfo, error) {
+	if repl, deleted := o.lookup(path); deleted {
+		return nil, os.ErrNotExist
+	} else if repl != "" {
+		path = repl
+	}
+	return os.Stat(path)
+}
+
+// tempFile writes o's replacements out to a temporary JSON file in the
+// format accepted by `go list/build -overlay`, so external invocations of
+// the go tool see the same overlay as the rest of go-app-stager. path is ""
+// if o is nil or empty, in which case there's nothing for the caller to
+// pass to the go tool. The returned cleanup func removes the temp file and
+// is always safe to call, including when path is "".
+func (o *overlay) tempFile() (path string, cleanup func(), err error) {
+	noop := func() {}
+	if o == nil || len(o.replace) == 0 {
+		return "", noop, nil
+	}
+	f := overlayFile{Replace: make(map[string]*string, len(o.replace))}
+	for orig, repl := range o.replace {
+		if repl == "" {
+			f.Replace[orig] = nil
+			continue
+		}
+		repl := repl
+		f.Replace[orig] = &repl
+	}
+	data, err := json.Marshal(f)
+	if err != nil {
+		return "", noop, fmt.Errorf("marshaling overlay: %v", err)
+	}
+	tmp, err := ioutil.TempFile("", "go-app-stager-overlay-*.json")
+	if err != nil {
+		return "", noop, fmt.Errorf("creating overlay temp file: %v", err)
+	}
+	cleanup = func() { os.Remove(tmp.Name()) }
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		cleanup()
+		return "", noop, fmt.Errorf("writing overlay temp file: %v", err)
+	}
+	if err := tmp.Close(); err != nil {
+		cleanup()
+		return "", noop, fmt.Errorf("closing overlay temp file: %v", err)
+	}
+	return tmp.Name(), cleanup, nil
+}
+
+// exists reports whether path exists, honoring the overlay.
+func (o *overlay) exists(path string) (bool, error) {
+	_, err := o.stat(path)
+	if err == nil {
+		return true, nil
+	}
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	return false, err
+}
+
+// isDir reports whether path is a directory, honoring the overlay. It
+// matches the signature of build.Context.IsDir.
+func (o *overlay) isDir(path string) bool {
+	fi, err := o.stat(path)
+	return err == nil && fi.IsDir()
+}
+
+// readDir lists dir's entries, honoring the overlay's replacements and
+// deletions of files directly within dir. It matches the signature of
+// build.Context.ReadDir.
+func (o *overlay) readDir(dir string) ([]os.FileInfo, error) {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	if o == nil {
+		return entries, nil
+	}
+	absDir, err := filepath.Abs(dir)
+	if err != nil {
+		return entries, nil
+	}
+	byName := make(map[string]os.FileInfo, len(entries))
+	for _, e := range entries {
+		byName[e.Name()] = e
+	}
+	for orig, repl := range o.replace {
+		if filepath.Dir(orig) != absDir {
+			continue
+		}
+		name := filepath.Base(orig)
+		if repl == "" {
+			delete(byName, name)
+			continue
+		}
+		fi, err := os.Stat(repl)
+		if err != nil {
+			return nil, fmt.Errorf("overlay replacement %q: %v", repl, err)
+		}
+		byName[name] = namedFileInfo{FileInfo: fi, name: name}
+	}
+	out := make([]os.FileInfo, 0, len(byName))
+	for _, fi := range byName {
+		out = append(out, fi)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Name() < out[j].Name() })
+	return out, nil
+}
+
+// namedFileInfo overrides the Name of an os.FileInfo, used to present an
+// overlay replacement file under its original name.
+type namedFileInfo struct {
+	os.FileInfo
+	name string
+}
+
+func (n namedFileInfo) Name() string { return n.name }
+
+// analyzedPackage pairs a build.Package with the additional files it pulls
+// in via //go:embed directives (Go 1.16+), which live outside pkg.Imports
+// and so must be tracked separately to be copied alongside the package's Go
+// source files.
+type analyzedPackage struct {
+	*build.Package
+	// embeds holds paths, relative to Package.Dir, of files resolved from
+	// //go:embed directives in the package's Go source files.
+	embeds []string
+}
+
 var (
 	skipFiles = map[string]bool{
 		".git":        true,
@@ -172,8 +451,14 @@ func main() {
 	src := flag.Arg(1)
 	dst := flag.Arg(2)
 
+	ov, err := readOverlay(*overlayFlag)
+	if err != nil {
+		log.Println(err)
+		os.Exit(1)
+	}
+
 	// Read and parse app.yaml file
-	c, err := readConfig(configPath)
+	c, err := readConfig(configPath, ov)
 	if err != nil {
 		log.Println(err)
 		os.Exit(1)
@@ -193,18 +478,28 @@ func main() {
 	} else if c.isFlex() {
 		tags = []string{"appenginevm"}
 	}
-	buildCtx := buildContext(tags, minorVer)
+	tags = append(tags, buildTagsFlag...)
+
+	goosList := splitOrDefault(*goosFlag, "linux")
+	goarchList := splitOrDefault(*goarchFlag, "amd64")
+	var buildCtxs []*build.Context
+	for _, goos := range goosList {
+		for _, goarch := range goarchList {
+			buildCtxs = append(buildCtxs, buildContext(goos, goarch, tags, minorVer, ov))
+		}
+	}
+
 	switch {
 	case c.isLegacyStandard():
-		if err := stageLegacyStandard(src, dst, buildCtx); err != nil {
+		if err := stageLegacyStandard(src, dst, buildCtxs, minorVer, ov); err != nil {
 			log.Fatalf("Staging Standard app: %s\n", err)
 		}
 	case c.isFlex():
-		if err := stageFlex(src, dst, buildCtx); err != nil {
+		if err := stageFlex(src, dst, buildCtxs, minorVer, ov); err != nil {
 			log.Fatalf("Staging Flex app: %s\n", err)
 		}
 	case c.isStandardSecondGen():
-		if err := stageStandardSecondGen(src, dst, buildCtx); err != nil {
+		if err := stageStandardSecondGen(src, dst, buildCtxs, minorVer, ov); err != nil {
 			log.Fatalf("Staging second-gen Standard app: %s\n", err)
 		}
 	default:
@@ -212,51 +507,108 @@ func main() {
 	}
 }
 
+// splitOrDefault splits a comma-separated flag value into a slice, or
+// returns a single-element slice containing def if val is empty.
+func splitOrDefault(val, def string) []string {
+	if val == "" {
+		return []string{def}
+	}
+	return strings.Split(val, ",")
+}
+
 // stageLegacyStandard Stages a legacy GAE Standard app. Does not supporting vendoring or modules.
-func stageLegacyStandard(src, dst string, buildCtx *build.Context) error {
-	// Find all dependencies for a build.Context for the release version and bundle their
+func stageLegacyStandard(src, dst string, buildCtxs []*build.Context, minorVer int, ov *overlay) error {
+	// Find all dependencies across the build context matrix and bundle their
 	// directories into the staged directory.
-	deps, err := analyze(src, buildCtx, false /* enforceMain */)
+	deps, err := analyzeMatrix(src, buildCtxs, false /* enforceMain */, minorVer, ov)
 	if err != nil {
-		return fmt.Errorf("failed analyzing %s: %v\nGOPATH: %s", src, err, buildCtx.GOPATH)
+		return fmt.Errorf("failed analyzing %s: %v", src, err)
 	}
-	if err = bundle(dst, "", deps); err != nil {
+	if err = bundle(dst, "", deps, ov); err != nil {
 		return fmt.Errorf("failed to bundle to %s: %v", dst, err)
 	}
-	if err = copyTree(dst, ".", src, true); err != nil {
+	if err = copyTree(dst, ".", src, true, ov); err != nil {
 		return fmt.Errorf("unable to copy root directory to /app: %v", err)
 	}
 	return nil
 }
 
 // stageFlex stages a GAE Flex app. Does not support modules.
-func stageFlex(src, dst string, buildCtx *build.Context) error {
+func stageFlex(src, dst string, buildCtxs []*build.Context, minorVer int, ov *overlay) error {
 	skippedPackages["appengine"] = false // Only exists for legacy App Engine Standard
 
 	mainPathFile := filepath.Join(dst, "_gopath", "main-package-path")
 	if err := writeMainPkgFile(mainPathFile, src); err != nil {
 		return fmt.Errorf("failed to write %s: %v", mainPathFile, err)
 	}
-	// Find all dependencies for a build.Context for the release version and bundle their
+	// Find all dependencies across the build context matrix and bundle their
 	// directories into the staged directory.
-	deps, err := analyze(src, buildCtx, true /* enforceMain */)
+	deps, err := analyzeMatrix(src, buildCtxs, true /* enforceMain */, minorVer, ov)
 	if err != nil {
-		return fmt.Errorf("failed analyzing %s: %v\nGOPATH: %s", src, err, buildCtx.GOPATH)
+		return fmt.Errorf("failed analyzing %s: %v", src, err)
 	}
-	if err = bundle(dst, filepath.Join("_gopath", "src"), deps); err != nil {
+	if err = bundle(dst, filepath.Join("_gopath", "src"), deps, ov); err != nil {
 		return fmt.Errorf("failed to bundle to %s: %v", dst, err)
 	}
-	if err = copyTree(dst, ".", src, true); err != nil {
+	if err = copyTree(dst, ".", src, true, ov); err != nil {
 		return fmt.Errorf("unable to copy root directory to /app: %v", err)
 	}
 	return nil
 }
 
+// analyzeMatrix runs analyze once per build context in buildCtxs and returns
+// the union of all discovered dependencies, so apps with //go:build
+// constraints that select platform-specific files (e.g. netgo vs. cgo,
+// arm64 Flex custom runtimes) get a complete staged dependency set.
+func analyzeMatrix(dir string, buildCtxs []*build.Context, enforceMain bool, minorVer int, ov *overlay) ([]*analyzedPackage, error) {
+	index := make(map[string]int) // key (see below) -> index into all
+	var all []*analyzedPackage
+	for _, ctx := range buildCtxs {
+		deps, err := analyze(dir, ctx, enforceMain, minorVer, ov)
+		if err != nil {
+			return nil, fmt.Errorf("GOOS=%s GOARCH=%s: %v", ctx.GOOS, ctx.GOARCH, err)
+		}
+		for _, pkg := range deps {
+			key := filepath.Join(pkg.SrcRoot, pkg.ImportPath)
+			if i, ok := index[key]; ok {
+				// A package's //go:build-selected files, and so its
+				// //go:embed directives, can differ per build context;
+				// union embeds rather than keeping only the first context's.
+				all[i].embeds = unionStrings(all[i].embeds, pkg.embeds)
+				continue
+			}
+			index[key] = len(all)
+			all = append(all, pkg)
+		}
+	}
+	return all, nil
+}
+
+// unionStrings returns the deduplicated union of a and b, preserving a's
+// order and then b's for elements not already in a.
+func unionStrings(a, b []string) []string {
+	seen := make(map[string]bool, len(a)+len(b))
+	out := make([]string, 0, len(a)+len(b))
+	for _, s := range a {
+		if !seen[s] {
+			seen[s] = true
+			out = append(out, s)
+		}
+	}
+	for _, s := range b {
+		if !seen[s] {
+			seen[s] = true
+			out = append(out, s)
+		}
+	}
+	return out
+}
+
 // stageStandardSecondGen stages an App Engine Standard second-gen app. Supports both vendoring and modules.
-func stageStandardSecondGen(src, dst string, buildCtx *build.Context) error {
+func stageStandardSecondGen(src, dst string, buildCtxs []*build.Context, minorVer int, ov *overlay) error {
 	skippedPackages["appengine"] = false // Only exists for legacy App Engine Standard
 
-	gmPath, err := goModPath(src)
+	gmPath, err := goModPath(src, ov)
 	if err != nil {
 		log.Fatalf("failed finding go.mod: %v\n", err)
 	}
@@ -268,30 +620,298 @@ func stageStandardSecondGen(src, dst string, buildCtx *build.Context) error {
 	//   else use old GOPATH behavior
 	if gmPath == "" || (go111module != "on" && filepath.HasPrefix(gmPath, build.Default.GOPATH)) {
 		fmt.Println("building with dependencies from GOPATH")
-		return stageFlex(src, dst, buildCtx)
+		return stageFlex(src, dst, buildCtxs, minorVer, ov)
 	}
 	fmt.Println("building with dependencies from go.mod")
 
-	// If a go.mod file was found, we assume all dependencies are either local
-	// to the module directory or will be fetched by the builder, so we don't
-	// need to walk the local filesystem or analyze imports.
 	mainPathFile := filepath.Join(dst, "_main-package-path")
 	if err := writeGoModMainPkgFile(mainPathFile, gmPath, src); err != nil {
 		return fmt.Errorf("failed to write %s: %v", mainPathFile, err)
 	}
 	srcRoot := filepath.Dir(gmPath)
 
-	// TODO Make sure this follows symlinks
-	if err = copyTree(dst, ".", srcRoot, true); err != nil {
-		return fmt.Errorf("unable to copy root directory to /app: %v", err)
+	// Compute the set of packages actually reachable from the app's main
+	// package (and any other packages in or below src) across the build
+	// context matrix, so we only upload what's
+	// needed instead of the whole module root (which balloons upload size
+	// for monorepos with unrelated commands).
+	pkgs, err := modDepsMatrix(src, buildCtxs, ov)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "warning: unable to compute module dependency graph (%v); copying entire module root\n", err)
+		// TODO Make sure this follows symlinks
+		if err := copyTree(dst, ".", srcRoot, true, ov); err != nil {
+			return fmt.Errorf("unable to copy root directory to /app: %v", err)
+		}
+		return nil
+	}
+
+	if err := copyModFiles(dst, srcRoot, pkgs, minorVer, ov); err != nil {
+		return fmt.Errorf("failed to copy module dependencies to %s: %v", dst, err)
 	}
 	return nil
 }
 
-// readConfig parses given app.yaml file path.
-func readConfig(path string) (*config, error) {
+// modPackage is the subset of `go list -json` package fields needed to
+// compute which directories must be staged for a module-mode app.
+type modPackage struct {
+	ImportPath string
+	Dir        string
+	Standard   bool
+	GoFiles    []string
+}
+
+// modDeps runs `go list -deps -json ./...` in appDir to compute, in module
+// mode, the transitive set of packages reachable from the app's main package
+// and from any other packages in or below appDir.
+// It shells out to the go tool rather than vendoring golang.org/x/tools/go/packages,
+// since go-app-stager ships as part of the Go distribution itself. ov, if
+// non-nil, is passed through to `go list` via -overlay so overlay-replaced
+// or -deleted files are reflected in the dependency graph.
+func modDeps(appDir, goos, goarch string, tags []string, ov *overlay) ([]modPackage, error) {
+	overlayPath, cleanup, err := ov.tempFile()
+	if err != nil {
+		return nil, fmt.Errorf("writing overlay for go list: %v", err)
+	}
+	defer cleanup()
+
+	args := []string{"list", "-deps", "-json"}
+	if len(tags) > 0 {
+		args = append(args, "-tags", strings.Join(tags, ","))
+	}
+	if overlayPath != "" {
+		args = append(args, "-overlay", overlayPath)
+	}
+	args = append(args, "./...")
+	cmd := exec.Command("go", args...)
+	cmd.Dir = appDir
+	cmd.Env = append(os.Environ(), "GOOS="+goos, "GOARCH="+goarch)
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("go list -deps failed: %v", err)
+	}
+	var pkgs []modPackage
+	dec := json.NewDecoder(bytes.NewReader(out))
+	for dec.More() {
+		var pkg modPackage
+		if err := dec.Decode(&pkg); err != nil {
+			return nil, fmt.Errorf("parsing go list output: %v", err)
+		}
+		pkgs = append(pkgs, pkg)
+	}
+	return pkgs, nil
+}
+
+// modDepsMatrix runs modDeps once per build context in buildCtxs and returns
+// the union of all discovered packages, deduplicated by directory.
+func modDepsMatrix(appDir string, buildCtxs []*build.Context, ov *overlay) ([]modPackage, error) {
+	index := make(map[string]int) // pkg.Dir -> index into all
+	var all []modPackage
+	for _, ctx := range buildCtxs {
+		pkgs, err := modDeps(appDir, ctx.GOOS, ctx.GOARCH, ctx.BuildTags, ov)
+		if err != nil {
+			return nil, fmt.Errorf("GOOS=%s GOARCH=%s: %v", ctx.GOOS, ctx.GOARCH, err)
+		}
+		for _, pkg := range pkgs {
+			if pkg.Dir == "" {
+				all = append(all, pkg)
+				continue
+			}
+			if i, ok := index[pkg.Dir]; ok {
+				// A package's //go:build-selected files, and so its
+				// //go:embed directives, can differ per build context;
+				// union GoFiles rather than keeping only the first
+				// context's.
+				all[i].GoFiles = unionStrings(all[i].GoFiles, pkg.GoFiles)
+				continue
+			}
+			index[pkg.Dir] = len(all)
+			all = append(all, pkg)
+		}
+	}
+	return all, nil
+}
+
+// copyModFiles copies only what's needed to build the app from srcRoot: the
+// module root's go.mod/go.sum/vendor manifest, and the directories of the
+// reachable in-module packages in pkgs (including any vendored ones), along
+// with any files those packages reference via //go:embed. Packages outside
+// the module root are skipped here; they're either fetched by the remote
+// builder or are local replace targets, handled separately.
+func copyModFiles(dst, srcRoot string, pkgs []modPackage, minorVer int, ov *overlay) error {
+	copied := make(map[string]bool)
+	for _, pkg := range pkgs {
+		if pkg.Standard || pkg.Dir == "" {
+			continue
+		}
+		rel, err := filepath.Rel(srcRoot, pkg.Dir)
+		if err != nil || strings.HasPrefix(rel, "..") {
+			continue
+		}
+		if copied[rel] {
+			continue
+		}
+		copied[rel] = true
+		if err := copyTree(dst, rel, pkg.Dir, false, ov); err != nil {
+			return fmt.Errorf("unable to copy package directory %s: %v", rel, err)
+		}
+		embeds, err := findEmbeds(&build.Package{Dir: pkg.Dir, GoFiles: pkg.GoFiles}, minorVer, ov)
+		if err != nil {
+			return fmt.Errorf("package %s: %v", pkg.ImportPath, err)
+		}
+		if err := copyEmbeds(dst, rel, pkg.Dir, embeds, ov); err != nil {
+			return err
+		}
+	}
+
+	// go.mod/go.sum/vendor/modules.txt are staged last: when a package's
+	// directory (often the main package's) is srcRoot, the copyTree call
+	// above for it has already written srcRoot's unrewritten go.mod (among
+	// its other top-level files).
+	// stageGoMod's rewritten replacement must overwrite that copy, not the
+	// other way around.
+	gmPath := filepath.Join(srcRoot, "go.mod")
+	if exists, err := ov.exists(gmPath); err != nil {
+		return err
+	} else if exists {
+		if err := stageGoMod(dst, srcRoot, gmPath, ov); err != nil {
+			return fmt.Errorf("staging go.mod: %v", err)
+		}
+	}
+
+	// go.sum is unaffected by rewriting local replace targets: filesystem
+	// replace targets aren't checksummed, so the sums already present for
+	// the replaced module versions still apply.
+	sumPath := filepath.Join(srcRoot, "go.sum")
+	if exists, err := ov.exists(sumPath); err == nil && exists {
+		if err := copyFile(dst, "go.sum", sumPath, ov); err != nil {
+			return err
+		}
+	}
+	modulesTxt := filepath.Join(srcRoot, "vendor", "modules.txt")
+	if exists, err := ov.exists(modulesTxt); err == nil && exists {
+		if err := copyFile(dst, filepath.Join("vendor", "modules.txt"), modulesTxt, ov); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// localReplaceDir is the staged directory under which go.mod `replace`
+// directives with filesystem targets are bundled.
+const localReplaceDir = "_local_replace"
+
+// localReplace describes a go.mod `replace` directive whose target is a
+// filesystem path rather than a module+version, and so won't be present in
+// the uploaded staged directory unless it's bundled alongside the app.
+type localReplace struct {
+	oldPath    string
+	oldVersion string
+	dir        string // absolute path to the replacement directory
+	bundled    string // path, relative to STAGED_DIR, it's copied to
+}
+
+// stageGoMod parses the go.mod at gmPath, rewrites any `replace` directives
+// with filesystem targets to point at a stable bundled location under
+// STAGED_DIR, copies those replacement directories there, and writes the
+// (possibly rewritten) go.mod into dst.
+func stageGoMod(dst, srcRoot, gmPath string, ov *overlay) error {
+	f, err := ov.openFile(gmPath)
+	if err != nil {
+		return fmt.Errorf("reading %s: %v", gmPath, err)
+	}
+	defer f.Close()
+	data, err := ioutil.ReadAll(f)
+	if err != nil {
+		return fmt.Errorf("reading %s: %v", gmPath, err)
+	}
+	mf, err := modfile.Parse(gmPath, data, nil)
+	if err != nil {
+		return fmt.Errorf("parsing %s: %v", gmPath, err)
+	}
+
+	var replaces []localReplace
+	for _, r := range mf.Replace {
+		if r.New.Version != "" {
+			continue // a module@version replacement, not a filesystem path
+		}
+		dir := r.New.Path
+		if !filepath.IsAbs(dir) {
+			dir = filepath.Join(srcRoot, dir)
+		}
+		sum := sha1.Sum([]byte(r.Old.Path + "@" + r.Old.Version))
+		bundled := filepath.Join(localReplaceDir, fmt.Sprintf("%x", sum))
+		replaces = append(replaces, localReplace{
+			oldPath:    r.Old.Path,
+			oldVersion: r.Old.Version,
+			dir:        dir,
+			bundled:    bundled,
+		})
+		// go.mod requires a filesystem replace target to start with "./",
+		// "../", or be absolute; a bare "_local_replace/..." is rejected by
+		// the go command when parsing the staged go.mod.
+		if err := mf.AddReplace(r.Old.Path, r.Old.Version, "./"+unixSeparators(bundled), ""); err != nil {
+			return fmt.Errorf("rewriting replace for %s: %v", r.Old.Path, err)
+		}
+	}
+
+	out := data
+	if len(replaces) > 0 {
+		mf.Cleanup()
+		out = modfile.Format(mf.Syntax)
+	}
+	if err := writeFile(dst, "go.mod", out); err != nil {
+		return err
+	}
+
+	for _, r := range replaces {
+		if !withinReplaceBoundary(r.dir, srcRoot) {
+			fmt.Fprintf(os.Stderr, "warning: replace directive for %s targets %s, outside the module root and -allow-replace-dir roots\n", r.oldPath, r.dir)
+		}
+		if err := copyTree(dst, r.bundled, r.dir, true, ov); err != nil {
+			return fmt.Errorf("unable to copy replace target %s for %s: %v", r.dir, r.oldPath, err)
+		}
+	}
+	return nil
+}
+
+// withinReplaceBoundary reports whether dir is under srcRoot or one of the
+// roots passed via -allow-replace-dir.
+func withinReplaceBoundary(dir, srcRoot string) bool {
+	for _, root := range append([]string{srcRoot}, allowedReplaceDirs...) {
+		absRoot, err := filepath.Abs(root)
+		if err != nil {
+			continue
+		}
+		rel, err := filepath.Rel(absRoot, dir)
+		if err == nil && !strings.HasPrefix(rel, "..") {
+			return true
+		}
+	}
+	return false
+}
+
+// writeFile writes data to name relative to dst, creating parent
+// directories as needed.
+func writeFile(dst, name string, data []byte) error {
+	p := filepath.Join(dst, name)
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		return fmt.Errorf("unable to create directory for %q: %v", name, err)
+	}
+	if err := ioutil.WriteFile(p, data, 0644); err != nil {
+		return fmt.Errorf("unable to write %q: %v", name, err)
+	}
+	return nil
+}
+
+// readConfig parses given app.yaml file path, honoring the overlay.
+func readConfig(path string, ov *overlay) (*config, error) {
 	c := &config{}
-	contents, err := ioutil.ReadFile(path)
+	f, err := ov.openFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %v", path, err)
+	}
+	defer f.Close()
+	contents, err := ioutil.ReadAll(f)
 	if err != nil {
 		return nil, fmt.Errorf("failed to read %s: %v", path, err)
 	}
@@ -512,25 +1132,30 @@ func readFlexRuntimesConfig() ([]byte, error) {
 	return body, nil
 }
 
-// buildContext returns the context for building the source.
-func buildContext(tags []string, minorVersion int) *build.Context {
+// buildContext returns the context for building the source. The returned
+// context's file system hooks honor ov, so that files replaced or deleted
+// by the overlay are reflected in import analysis.
+func buildContext(goos, goarch string, tags []string, minorVersion int, ov *overlay) *build.Context {
 	var rels []string
 	for i := 1; i <= minorVersion; i++ {
 		rels = append(rels, fmt.Sprintf("go1.%d", i))
 	}
 	return &build.Context{
-		GOARCH:      "amd64",
-		GOOS:        "linux",
+		GOARCH:      goarch,
+		GOOS:        goos,
 		GOROOT:      "",
 		GOPATH:      build.Default.GOPATH,
 		Compiler:    build.Default.Compiler,
 		BuildTags:   tags,
 		ReleaseTags: rels,
+		OpenFile:    ov.openFile,
+		ReadDir:     ov.readDir,
+		IsDir:       ov.isDir,
 	}
 }
 
 // enforceMain, if not main will return an error.
-func analyze(dir string, ctx *build.Context, enforceMain bool) ([]*build.Package, error) {
+func analyze(dir string, ctx *build.Context, enforceMain bool, minorVer int, ov *overlay) ([]*analyzedPackage, error) {
 	visited := make(map[importFrom]bool)
 	var imports []importFrom
 	abs, err := filepath.Abs(dir)
@@ -550,7 +1175,7 @@ func analyze(dir string, ctx *build.Context, enforceMain bool) ([]*build.Package
 			fromDir: abs,
 		})
 	}
-	packages := make([]*build.Package, 0)
+	packages := make([]*analyzedPackage, 0)
 	visitedPackages := make(map[string]bool)
 	for len(imports) != 0 {
 		i := imports[0]
@@ -572,7 +1197,11 @@ func analyze(dir string, ctx *build.Context, enforceMain bool) ([]*build.Package
 		name := filepath.Join(pkg.SrcRoot, pkg.ImportPath)
 		if _, ok := visitedPackages[name]; !ok {
 			visitedPackages[name] = true
-			packages = append(packages, pkg)
+			embeds, err := findEmbeds(pkg, minorVer, ov)
+			if err != nil {
+				return nil, fmt.Errorf("package %s: %v", pkg.ImportPath, err)
+			}
+			packages = append(packages, &analyzedPackage{Package: pkg, embeds: embeds})
 		}
 		// Recursively add new imports
 		for _, importPath := range pkg.Imports {
@@ -585,26 +1214,305 @@ func analyze(dir string, ctx *build.Context, enforceMain bool) ([]*build.Package
 	return packages, nil
 }
 
-// bundle copies package dependencies to staged _gopath/src/.
-func bundle(dst, dstDepsDir string, deps []*build.Package) error {
+// embedDirectiveRE matches a //go:embed directive comment line, capturing
+// the space-separated list of patterns that follow. It intentionally
+// doesn't handle quoted patterns containing spaces, which is uncommon.
+var embedDirectiveRE = regexp.MustCompile(`^//go:embed\s+(.+?)\s*$`)
+
+// findEmbeds scans pkg's Go source files for //go:embed directives (Go
+// 1.16+) and resolves the patterns they reference to files relative to
+// pkg.Dir, so those files can be copied alongside the package's source when
+// staging. It is a no-op for Go versions that predate //go:embed.
+func findEmbeds(pkg *build.Package, minorVer int, ov *overlay) ([]string, error) {
+	if minorVer < 16 {
+		return nil, nil
+	}
+	var embeds []string
+	for _, name := range pkg.GoFiles {
+		patterns, err := embedPatternsInFile(filepath.Join(pkg.Dir, name), ov)
+		if err != nil {
+			return nil, fmt.Errorf("reading %s for go:embed directives: %v", name, err)
+		}
+		for _, pattern := range patterns {
+			files, err := resolveEmbedPattern(pkg.Dir, pattern, ov)
+			if err != nil {
+				return nil, err
+			}
+			if len(files) == 0 {
+				return nil, fmt.Errorf("pattern %s: no matching files found", pattern)
+			}
+			embeds = append(embeds, files...)
+		}
+	}
+	return embeds, nil
+}
+
+// embedPatternsInFile scans a single Go source file for //go:embed
+// directives, returning the patterns of any that immediately precede a var
+// declaration (matching the placement go build requires).
+func embedPatternsInFile(path string, ov *overlay) ([]string, error) {
+	f, err := ov.openFile(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var patterns []string
+	var pending []string
+	inVarBlock := false
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		switch {
+		case line == "":
+			continue
+		case embedDirectiveRE.MatchString(line):
+			m := embedDirectiveRE.FindStringSubmatch(line)
+			pending = append(pending, strings.Fields(m[1])...)
+		case strings.HasPrefix(line, "//"):
+			// Other comment lines don't break a pending directive.
+			continue
+		case strings.HasPrefix(line, "var ("):
+			inVarBlock = true
+			pending = nil
+		case inVarBlock && line == ")":
+			inVarBlock = false
+			pending = nil
+		case strings.HasPrefix(line, "var "), line == "var":
+			patterns = append(patterns, pending...)
+			pending = nil
+		case inVarBlock:
+			// Inside a var (...) block, a directive attaches to the var
+			// spec line immediately below it (e.g. "s string"), which
+			// doesn't itself start with "var ".
+			patterns = append(patterns, pending...)
+			pending = nil
+		default:
+			pending = nil
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return patterns, nil
+}
+
+// resolveEmbedPattern resolves a single //go:embed pattern against dir,
+// using glob semantics extended the way the go command extends them: a
+// pattern prefixed with "all:" also matches dotfiles and underscore-prefixed
+// files, and a pattern naming a directory embeds that directory's contents
+// recursively. Lookups go through ov, so a file supplied only via -overlay
+// (with no on-disk original) can be embedded, and one the overlay deletes
+// can't. Returned paths are relative to dir and use "/" separators.
+func resolveEmbedPattern(dir, pattern string, ov *overlay) ([]string, error) {
+	all := strings.HasPrefix(pattern, "all:")
+	pattern = strings.TrimPrefix(pattern, "all:")
+
+	matches, err := ovGlob(filepath.Join(dir, filepath.FromSlash(pattern)), ov)
+	if err != nil {
+		return nil, fmt.Errorf("invalid embed pattern %q: %v", pattern, err)
+	}
+	var files []string
+	for _, m := range matches {
+		fi, err := ov.stat(m)
+		if err != nil {
+			return nil, fmt.Errorf("embed pattern %q: %v", pattern, err)
+		}
+		if !fi.IsDir() {
+			rel, err := filepath.Rel(dir, m)
+			if err != nil {
+				return nil, err
+			}
+			files = append(files, unixSeparators(rel))
+			continue
+		}
+		err = ovWalk(m, ov, func(p string, info os.FileInfo) error {
+			name := info.Name()
+			if info.IsDir() {
+				if p != m && !all && (strings.HasPrefix(name, ".") || strings.HasPrefix(name, "_")) {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			if !all && (strings.HasPrefix(name, ".") || strings.HasPrefix(name, "_")) {
+				return nil
+			}
+			rel, err := filepath.Rel(dir, p)
+			if err != nil {
+				return err
+			}
+			files = append(files, unixSeparators(rel))
+			return nil
+		})
+		if err != nil {
+			return nil, fmt.Errorf("embed pattern %q: %v", pattern, err)
+		}
+	}
+	return files, nil
+}
+
+// hasGlobMeta reports whether path contains any of the filepath.Match
+// metacharacters "*", "?" or "["; a backslash is not treated as special.
+func hasGlobMeta(path string) bool {
+	return strings.ContainsAny(path, "*?[")
+}
+
+// ovGlob is like filepath.Glob but resolves paths through ov, so it can
+// match a file that exists only via -overlay and won't match one the
+// overlay deletes.
+func ovGlob(pattern string, ov *overlay) ([]string, error) {
+	if !hasGlobMeta(pattern) {
+		if exists, err := ov.exists(pattern); err != nil {
+			return nil, err
+		} else if !exists {
+			return nil, nil
+		}
+		return []string{pattern}, nil
+	}
+
+	dir, file := filepath.Split(pattern)
+	dir = cleanGlobDir(dir)
+
+	if !hasGlobMeta(dir) {
+		return ovGlobDir(dir, file, nil, ov)
+	}
+	if dir == pattern {
+		return nil, filepath.ErrBadPattern
+	}
+
+	dirs, err := ovGlob(dir, ov)
+	if err != nil {
+		return nil, err
+	}
+	var matches []string
+	for _, d := range dirs {
+		matches, err = ovGlobDir(d, file, matches, ov)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return matches, nil
+}
+
+// cleanGlobDir mirrors filepath.Glob's handling of the directory portion of
+// a split pattern: an empty directory means "search the current directory".
+func cleanGlobDir(dir string) string {
+	switch dir {
+	case "":
+		return "."
+	case string(filepath.Separator):
+		return dir
+	default:
+		return dir[:len(dir)-1]
+	}
+}
+
+// ovGlobDir lists dir through ov and appends its entries matching pattern to
+// matches, mirroring filepath.Glob's internal (unexported) glob() helper.
+func ovGlobDir(dir, pattern string, matches []string, ov *overlay) ([]string, error) {
+	if !ov.isDir(dir) {
+		return matches, nil
+	}
+	entries, err := ov.readDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, e := range entries {
+		n := e.Name()
+		matched, err := filepath.Match(pattern, n)
+		if err != nil {
+			return nil, err
+		}
+		if matched {
+			matches = append(matches, filepath.Join(dir, n))
+		}
+	}
+	return matches, nil
+}
+
+// ovWalk walks the tree rooted at root like filepath.Walk (including its
+// SkipDir convention), but resolves files and directories through ov the
+// same way copyTree does, so overlay replacements and deletions apply.
+func ovWalk(root string, ov *overlay, fn func(path string, info os.FileInfo) error) error {
+	info, err := ov.stat(root)
+	if err != nil {
+		return err
+	}
+	return ovWalkEntry(root, info, ov, fn)
+}
+
+func ovWalkEntry(path string, info os.FileInfo, ov *overlay, fn func(string, os.FileInfo) error) error {
+	if err := fn(path, info); err != nil {
+		if info.IsDir() && err == filepath.SkipDir {
+			return nil
+		}
+		return err
+	}
+	if !info.IsDir() {
+		return nil
+	}
+	entries, err := ov.readDir(path)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		p := filepath.Join(path, entry.Name())
+		fi := entry
+		if fi.Mode()&os.ModeSymlink == os.ModeSymlink {
+			if fi, err = ov.stat(p); err != nil {
+				return err
+			}
+		}
+		if err := ovWalkEntry(p, fi, ov, fn); err != nil {
+			if fi.IsDir() && err == filepath.SkipDir {
+				continue
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// bundle copies package dependencies, and any files they reference via
+// //go:embed, to staged _gopath/src/.
+func bundle(dst, dstDepsDir string, deps []*analyzedPackage, ov *overlay) error {
 	for _, pkg := range deps {
 		dstDir := filepath.Join(dstDepsDir, pkg.ImportPath)
 		srcDir := filepath.Join(pkg.SrcRoot, pkg.ImportPath)
-		if err := copyTree(dst, dstDir, srcDir, false); err != nil {
+		if err := copyTree(dst, dstDir, srcDir, false, ov); err != nil {
 			return fmt.Errorf("unable to copy directory %v to %v: %v", srcDir, dstDir, err)
 		}
+		if err := copyEmbeds(dst, dstDir, pkg.Dir, pkg.embeds, ov); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// copyEmbeds copies the files named by embeds (paths relative to srcDir, as
+// returned by findEmbeds) into dstDir relative to dst.
+func copyEmbeds(dst, dstDir, srcDir string, embeds []string, ov *overlay) error {
+	for _, rel := range embeds {
+		d := filepath.Join(dstDir, rel)
+		if err := os.MkdirAll(filepath.Join(dst, filepath.Dir(d)), 0755); err != nil {
+			return fmt.Errorf("unable to create directory for embedded file %v: %v", rel, err)
+		}
+		if err := copyFile(dst, d, filepath.Join(srcDir, rel), ov); err != nil {
+			return fmt.Errorf("unable to copy embedded file %v: %v", rel, err)
+		}
 	}
 	return nil
 }
 
-// copyTree copies srcDir to dstDir relative to dstRoot, ignoring skipFiles.
-func copyTree(dstRoot, dstDir, srcDir string, recursive bool) error {
+// copyTree copies srcDir to dstDir relative to dstRoot, ignoring skipFiles
+// and honoring ov's replacements and deletions.
+func copyTree(dstRoot, dstDir, srcDir string, recursive bool, ov *overlay) error {
 	d := filepath.Join(dstRoot, dstDir)
 	if err := os.MkdirAll(d, 0755); err != nil {
 		return fmt.Errorf("unable to create directory %q: %v", d, err)
 	}
 
-	entries, err := ioutil.ReadDir(srcDir)
+	entries, err := ov.readDir(srcDir)
 	if err != nil {
 		return fmt.Errorf("unable to read dir %q: %v", srcDir, err)
 	}
@@ -616,7 +1524,7 @@ func copyTree(dstRoot, dstDir, srcDir string, recursive bool) error {
 			continue
 		}
 		if entry.Mode()&os.ModeSymlink == os.ModeSymlink {
-			if entry, err = os.Stat(s); err != nil {
+			if entry, err = ov.stat(s); err != nil {
 				return fmt.Errorf("unable to stat %v: %v", s, err)
 			}
 		}
@@ -625,12 +1533,12 @@ func copyTree(dstRoot, dstDir, srcDir string, recursive bool) error {
 			if !recursive {
 				continue
 			}
-			if err := copyTree(dstRoot, d, s, recursive); err != nil {
+			if err := copyTree(dstRoot, d, s, recursive, ov); err != nil {
 				return fmt.Errorf("unable to copy dir %q to %q: %v", s, d, err)
 			}
 			continue
 		}
-		if err := copyFile(dstRoot, d, s); err != nil {
+		if err := copyFile(dstRoot, d, s, ov); err != nil {
 			return fmt.Errorf("unable to copy dir %q to %q: %v", s, d, err)
 		}
 		fmt.Fprintf(os.Stderr, "copied %s to %s\n", s, filepath.Join(dstRoot, d))
@@ -638,9 +1546,10 @@ func copyTree(dstRoot, dstDir, srcDir string, recursive bool) error {
 	return nil
 }
 
-// copyFile copies src to dst relative to dstRoot.
-func copyFile(dstRoot, dst, src string) error {
-	s, err := os.Open(src)
+// copyFile copies src to dst relative to dstRoot, honoring ov's replacements
+// and deletions of src.
+func copyFile(dstRoot, dst, src string, ov *overlay) error {
+	s, err := ov.openFile(src)
 	if err != nil {
 		return fmt.Errorf("unable to open %q: %v", src, err)
 	}
@@ -664,21 +1573,21 @@ func copyFile(dstRoot, dst, src string) error {
 
 // goModPath searches up the directory tree for a go.mod file, stopping at the
 // first match and returning the path to the go.mod file. If no go.mod file is
-// found, returns an empty string.
-func goModPath(src string) (string, error) {
+// found, returns an empty string. Honors ov's replacements and deletions.
+func goModPath(src string, ov *overlay) (string, error) {
 	src, err := filepath.Abs(src)
 	if err != nil {
 		return "", fmt.Errorf("src abspath: %v", err)
 	}
 	for {
 		p := filepath.Join(src, "go.mod")
-		_, err := os.Stat(p)
-		if err == nil {
-			return p, nil
-		}
-		if !os.IsNotExist(err) {
+		exists, err := ov.exists(p)
+		if err != nil {
 			return "", fmt.Errorf("unexpected error: %v", err)
 		}
+		if exists {
+			return p, nil
+		}
 		oldSrc := src
 		src = filepath.Dir(src)
 		if oldSrc == src {